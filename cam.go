@@ -3,13 +3,19 @@
 package cam
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"math/rand"
 	"mime"
 	"mime/multipart"
 	"net/http"
+	"net/textproto"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -17,17 +23,39 @@ import (
 
 // A Camera is a set of configuration data for an mjpeg camera
 type Camera struct {
-	Name      string // name of the camera; name will be passed along with frames
-	URL       string // url of the camera
-	Username  string // optional username for basic authentication
-	Password  string // optional password for basic authentication
-	Log       bool   // should log
-	LastFrame *Frame
-	Reconnect bool          // should automatically retry
-	body      io.ReadCloser // a reference to the http response body
-	listeners []chan Frame  // slice of channels returned from the Subscribe method
-	mutex     sync.Mutex
-	locked    bool // lock to prevent multiple keepalive goroutines
+	Name                string // name of the camera; name will be passed along with frames
+	URL                 string // url of the camera
+	Username            string // optional username for basic authentication
+	Password            string // optional password for basic authentication
+	Log                 bool   // should log
+	LastFrame           *Frame
+	Reconnect           bool          // should automatically retry
+	HeartbeatInterval   time.Duration // how often to check for frame progress, defaults to 10s
+	MaxMissedHeartbeats uint          // consecutive stale intervals allowed before stop is called, defaults to 1
+	TLSConfig           *tls.Config   // optional base tls.Config; a copy is used, with the fields below applied on top of it
+	RootCAsPEM          []byte        // PEM-encoded CA bundle trusted in addition to the system root pool
+	ClientCertPEM       []byte        // PEM-encoded client certificate for mutual TLS
+	ClientKeyPEM        []byte        // PEM-encoded client key for mutual TLS
+	InsecureSkipVerify  bool          // disable server certificate verification
+	BackoffPolicy       BackoffPolicy // controls the delay between reconnect attempts
+	Events              chan Event    // optional; if set, receives ReconnectEvents as reconnects are attempted
+	MinFrameInterval    time.Duration // optional; Handler drops frames delivered faster than this
+	body                io.ReadCloser // a reference to the http response body
+	listeners           []*subscriber // slice of subscriptions returned from the Subscribe method
+	mutex               sync.Mutex
+	keepaliveStop       chan struct{}      // signals the running keepalive goroutine to exit
+	transport           *http.Transport    // cached across reconnects once built
+	ctx                 context.Context    // context for the current connection, cancelled by stop
+	cancel              context.CancelFunc // cancels ctx, interrupting any in-flight read
+	generation          uint64             // bumped each time a new first-subscriber connection starts
+}
+
+// subscriber pairs a listener channel with the context of the caller that
+// created it, so emit can stop trying to deliver frames to it without
+// relying on recover() to paper over a send on a closed channel.
+type subscriber struct {
+	ch  chan Frame
+	ctx context.Context
 }
 
 // A Frame is a container for jpeg data from a Camera
@@ -36,13 +64,90 @@ type Frame struct {
 	Number     uint64    // a monotomically incremented frame count
 	Timestamp  time.Time // time the frame was received
 	Bytes      []byte    // jpeg data
+	Err        error     // set on the final frame delivered when reconnecting is given up on
+}
+
+// BackoffPolicy configures the delay between reconnect attempts. The delay
+// starts at InitialInterval and grows by Multiplier on each attempt, capped
+// at MaxInterval, with up to ±JitterFraction of uniform jitter applied.
+// MaxAttempts caps the number of reconnect attempts; 0 means unlimited.
+type BackoffPolicy struct {
+	InitialInterval time.Duration
+	MaxInterval     time.Duration
+	Multiplier      float64
+	JitterFraction  float64
+	MaxAttempts     uint
+}
+
+// delay returns the backoff delay to wait before the given 1-indexed
+// reconnect attempt.
+func (p BackoffPolicy) delay(attempt uint) time.Duration {
+	initial := p.InitialInterval
+	if initial <= 0 {
+		initial = time.Second * 3
+	}
+	max := p.MaxInterval
+	if max <= 0 {
+		max = time.Second * 30
+	}
+	mult := p.Multiplier
+	if mult <= 0 {
+		mult = 2
+	}
+
+	d := float64(initial)
+	for i := uint(1); i < attempt; i++ {
+		d *= mult
+		if d >= float64(max) {
+			d = float64(max)
+			break
+		}
+	}
+
+	if p.JitterFraction > 0 {
+		jitter := d * p.JitterFraction
+		d += (rand.Float64()*2 - 1) * jitter
+		if d < 0 {
+			d = 0
+		}
+	}
+
+	return time.Duration(d)
+}
+
+// Event is implemented by events sent on a Camera's Events channel.
+type Event interface {
+	isEvent()
+}
+
+// ReconnectEvent reports a single reconnect attempt, successful or not.
+type ReconnectEvent struct {
+	CameraName string
+	Attempt    uint
+	Delay      time.Duration
+	Err        error // set if the attempt failed
+}
+
+func (ReconnectEvent) isEvent() {}
+
+// emitEvent sends e on cam.Events without blocking if nobody is listening.
+func (cam *Camera) emitEvent(e Event) {
+	if cam.Events == nil {
+		return
+	}
+	select {
+	case cam.Events <- e:
+	default:
+	}
 }
 
 // start connects to the camera, parses the header information of
 // the response to validate, and spawns a goroutine to read from the
-// connection
-func (cam *Camera) start() error {
-	resp, err := cam.connect()
+// connection. gen identifies the logical connection lifetime started by
+// the triggering SubscribeContext call, so the spawned read goroutine
+// can tell a stale teardown from one that still applies to it.
+func (cam *Camera) start(ctx context.Context, gen uint64) error {
+	resp, err := cam.connect(ctx)
 	if err != nil {
 		return err
 	}
@@ -59,7 +164,7 @@ func (cam *Camera) start() error {
 	if ok && strings.HasPrefix(mediaType, "multipart/") {
 		reader := multipart.NewReader(resp.Body, boundary)
 		cam.logf("[%s] begin reading", cam.Name)
-		go cam.read(reader)
+		go cam.read(ctx, gen, reader)
 	} else {
 		return fmt.Errorf("Received a non-multipart mime type from %s", cam.URL)
 	}
@@ -67,8 +172,8 @@ func (cam *Camera) start() error {
 }
 
 // connect handles the basic http connection to the camera
-func (cam *Camera) connect() (*http.Response, error) {
-	req, err := http.NewRequest("GET", cam.URL, nil)
+func (cam *Camera) connect(ctx context.Context) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", cam.URL, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -77,13 +182,116 @@ func (cam *Camera) connect() (*http.Response, error) {
 		req.SetBasicAuth(cam.Username, cam.Password)
 	}
 
-	client := &http.Client{}
+	transport, err := cam.httpTransport()
+	if err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{Transport: transport}
 	return client.Do(req)
 }
 
-// stop handles signaling the connection close
+// httpTransport lazily builds an *http.Transport from the TLS fields and
+// caches it on the Camera, so reconnects reuse the same transport (and its
+// connection pool) instead of paying for a fresh one on every attempt.
+func (cam *Camera) httpTransport() (*http.Transport, error) {
+	cam.mutex.Lock()
+	defer cam.mutex.Unlock()
+
+	if cam.transport != nil {
+		return cam.transport, nil
+	}
+
+	if cam.TLSConfig == nil && cam.RootCAsPEM == nil && cam.ClientCertPEM == nil &&
+		cam.ClientKeyPEM == nil && !cam.InsecureSkipVerify {
+		cam.transport = &http.Transport{}
+		return cam.transport, nil
+	}
+
+	var tlsConfig *tls.Config
+	if cam.TLSConfig != nil {
+		tlsConfig = cam.TLSConfig.Clone()
+	} else {
+		tlsConfig = &tls.Config{}
+	}
+
+	if cam.InsecureSkipVerify {
+		tlsConfig.InsecureSkipVerify = true
+	}
+
+	if cam.RootCAsPEM != nil {
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(cam.RootCAsPEM) {
+			return nil, fmt.Errorf("cam: unable to parse RootCAsPEM for %s", cam.Name)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if cam.ClientCertPEM != nil || cam.ClientKeyPEM != nil {
+		cert, err := tls.X509KeyPair(cam.ClientCertPEM, cam.ClientKeyPEM)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	cam.transport = &http.Transport{TLSClientConfig: tlsConfig}
+	return cam.transport, nil
+}
+
+// NewCameraFromCAFile reads the PEM-encoded CA bundle at path and returns a
+// Camera whose RootCAsPEM is seeded from it, so the camera's TLS connections
+// trust that CA in addition to the system root pool.
+func NewCameraFromCAFile(path string) (*Camera, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Camera{RootCAsPEM: pem}, nil
+}
+
+// stop handles signaling the connection close. Cancelling ctx interrupts
+// an in-flight mr.NextPart() directly, rather than relying on body.Close()
+// racing with the read() goroutine.
 func (cam *Camera) stop() {
-	cam.body.Close()
+	cam.mutex.Lock()
+	cam.stopLocked()
+	cam.mutex.Unlock()
+}
+
+// stopLocked is stop() for callers that already hold cam.mutex.
+func (cam *Camera) stopLocked() {
+	if cam.keepaliveStop != nil {
+		select {
+		case <-cam.keepaliveStop:
+		default:
+			close(cam.keepaliveStop)
+		}
+	}
+	if cam.cancel != nil {
+		cam.cancel()
+	}
+	if cam.body != nil {
+		cam.body.Close()
+	}
+}
+
+// stopGen tears down the connection only if gen is still the current
+// generation. read and keepalive call this instead of stop() when they
+// wind down on their own (EOF, missed heartbeats), so a goroutine left
+// over from a connection that Unsubscribe already tore down can't reach
+// into a newer generation's cam.cancel/cam.body and cancel or close them
+// out from under it.
+func (cam *Camera) stopGen(gen uint64) {
+	cam.mutex.Lock()
+	defer cam.mutex.Unlock()
+	if cam.generation != gen {
+		return
+	}
+	cam.stopLocked()
 }
 
 func (cam *Camera) log(l ...interface{}) {
@@ -98,43 +306,113 @@ func (cam *Camera) logf(t string, l ...interface{}) {
 	}
 }
 
-func (cam *Camera) keepalive() {
-	if cam.locked || !cam.Reconnect {
-		return
+// keepalive runs as a single goroutine for the lifetime of a connection,
+// ticking every HeartbeatInterval and checking whether LastFrame is still
+// advancing. Once MaxMissedHeartbeats consecutive ticks find a stale
+// LastFrame, it calls stopGen(gen). It exits immediately if stopCh is
+// closed, which happens whenever stop() runs for any other reason.
+func (cam *Camera) keepalive(stopCh chan struct{}, gen uint64) {
+	interval := cam.HeartbeatInterval
+	if interval == 0 {
+		interval = time.Second * 10
 	}
-	cam.locked = true
-	time.Sleep(time.Second * 10)
-	cam.locked = false
-	if cam.LastFrame != nil &&
-		time.Since(cam.LastFrame.Timestamp) > time.Second*10 {
-		cam.stop()
-	} else {
-		go cam.keepalive()
+	maxMissed := cam.MaxMissedHeartbeats
+	if maxMissed == 0 {
+		maxMissed = 1
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var missed uint
+	var lastTimestamp time.Time
+
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			cam.mutex.Lock()
+			frame := cam.LastFrame
+			cam.mutex.Unlock()
+
+			// No frame has arrived yet; a slow-starting camera isn't stale,
+			// so keep waiting instead of counting a missed heartbeat.
+			if frame == nil {
+				continue
+			}
+
+			if frame.Timestamp.After(lastTimestamp) {
+				lastTimestamp = frame.Timestamp
+				missed = 0
+				continue
+			}
+
+			missed++
+			if missed >= maxMissed {
+				cam.stopGen(gen)
+				return
+			}
+		}
 	}
 }
 
 // read will read data from the response until eof or the response
-// body is closed
-func (cam *Camera) read(mr *multipart.Reader) {
+// body is closed. gen is the generation start() was called under; it is
+// threaded through to giveUp and keepalive so a stale goroutine can't
+// act on a connection that has since been superseded.
+func (cam *Camera) read(ctx context.Context, gen uint64, mr *multipart.Reader) {
 	defer func() {
-		if !cam.Reconnect {
+		cam.mutex.Lock()
+		reconnect := cam.Reconnect && cam.generation == gen
+		if reconnect && ctx.Err() != nil {
+			// stopGen cancelled this connection's ctx on the way out (EOF or
+			// missed heartbeats); reconnect attempts get a fresh one.
+			ctx, cam.cancel = context.WithCancel(context.Background())
+			cam.ctx = ctx
+		}
+		cam.mutex.Unlock()
+		if !reconnect {
 			return
 		}
 
 		cam.logf("[%s] Reconnecting", cam.Name)
-		err := cam.start()
+		var attempt uint
+		err := cam.start(ctx, gen)
 		for err != nil {
-			log.Printf("[%s] Unable to reconnect. Retrying...", cam.Name)
-			time.Sleep(time.Second * 3)
-			err = cam.start()
+			attempt++
+			if cam.BackoffPolicy.MaxAttempts > 0 && attempt > cam.BackoffPolicy.MaxAttempts {
+				cam.logf("[%s] Giving up after %d reconnect attempts", cam.Name, attempt-1)
+				cam.emitEvent(ReconnectEvent{CameraName: cam.Name, Attempt: attempt, Err: err})
+				cam.giveUp(gen, err)
+				return
+			}
+
+			delay := cam.BackoffPolicy.delay(attempt)
+			cam.emitEvent(ReconnectEvent{CameraName: cam.Name, Attempt: attempt, Delay: delay, Err: err})
+			cam.logf("[%s] Unable to reconnect. Retrying in %s...", cam.Name, delay)
+			time.Sleep(delay)
+			if ctx.Err() != nil {
+				return
+			}
+			err = cam.start(ctx, gen)
 		}
+		cam.emitEvent(ReconnectEvent{CameraName: cam.Name, Attempt: attempt + 1})
 	}()
 
 	start := time.Now()
 	frames := 0
 
-	if cam.Reconnect {
-		go cam.keepalive()
+	cam.mutex.Lock()
+	reconnect := cam.Reconnect
+	cam.mutex.Unlock()
+
+	if reconnect {
+		cam.mutex.Lock()
+		cam.keepaliveStop = make(chan struct{})
+		stopCh := cam.keepaliveStop
+		cam.mutex.Unlock()
+		go cam.keepalive(stopCh, gen)
 	}
 
 	for i := 0; ; i++ {
@@ -152,9 +430,10 @@ func (cam *Camera) read(mr *multipart.Reader) {
 
 		if err != nil {
 			if err == io.EOF ||
-				strings.Contains(err.Error(), "NextPart") {
+				strings.Contains(err.Error(), "NextPart") ||
+				strings.Contains(err.Error(), "context canceled") {
 				cam.log("EOF found")
-				cam.stop()
+				cam.stopGen(gen)
 			} else {
 				cam.log(err)
 			}
@@ -178,64 +457,198 @@ func (cam *Camera) read(mr *multipart.Reader) {
 			Bytes:      jpeg,
 			Timestamp:  time.Now(),
 		}
+		cam.mutex.Lock()
 		cam.LastFrame = &frame
+		cam.mutex.Unlock()
 		cam.emit(frame)
 	}
 }
 
-// emit will send frames to cam listeners
+// giveUp delivers a final Frame carrying err to every listener whose buffer
+// has room (a full listener gets none) and closes all their channels, once
+// reconnect attempts have been exhausted. It is a
+// no-op if gen is no longer the current generation, so a backoff loop
+// left over from a connection Unsubscribe already tore down can't clear
+// out the listeners of a newer one.
+func (cam *Camera) giveUp(gen uint64, err error) {
+	cam.mutex.Lock()
+	if cam.generation != gen {
+		cam.mutex.Unlock()
+		return
+	}
+	subs := cam.listeners
+	cam.listeners = make([]*subscriber, 0)
+	cam.mutex.Unlock()
+
+	frame := Frame{CameraName: cam.Name, Timestamp: time.Now(), Err: err}
+	for _, s := range subs {
+		select {
+		case s.ch <- frame:
+		case <-s.ctx.Done():
+		default:
+		}
+		close(s.ch)
+	}
+}
+
+// emit will send frames to cam listeners. It holds cam.mutex for the whole
+// loop, the same lock Unsubscribe closes a listener's channel under, so a
+// close can never race a send into that channel; select-with-default then
+// only has to worry about a full buffer, dropping the frame for that
+// subscriber instead of blocking delivery to everyone else.
 func (cam *Camera) emit(frame Frame) {
-	// Since there's no way to test if a channel is closed
-	// just recover
-	defer func() { recover() }()
-	for _, l := range cam.listeners {
-		l <- frame
+	cam.mutex.Lock()
+	defer cam.mutex.Unlock()
+
+	for _, s := range cam.listeners {
+		select {
+		case s.ch <- frame:
+		case <-s.ctx.Done():
+		default:
+		}
 	}
 }
 
 // Subscribe creates a new channel that receives Frames.
 // To unsubscribe, pass the returned channel to the Unsubscribe method.
 func (cam *Camera) Subscribe() (<-chan Frame, error) {
-	var err error
+	return cam.SubscribeContext(context.Background())
+}
+
+// SubscribeContext is like Subscribe but ties the subscription to ctx:
+// when ctx is done, the returned channel is automatically unsubscribed.
+func (cam *Camera) SubscribeContext(ctx context.Context) (<-chan Frame, error) {
 	l := make(chan Frame, 20)
-	go func() {
-		cam.mutex.Lock()
-		if len(cam.listeners) == 0 {
-			err = cam.start()
-		}
-		cam.listeners = append(cam.listeners, l)
-		cam.mutex.Unlock()
-	}()
+
+	cam.mutex.Lock()
+	first := len(cam.listeners) == 0
+	var connCtx context.Context
+	var gen uint64
+	if first {
+		var cancel context.CancelFunc
+		connCtx, cancel = context.WithCancel(context.Background())
+		cam.ctx = connCtx
+		cam.cancel = cancel
+		cam.generation++
+		gen = cam.generation
+	}
+	cam.listeners = append(cam.listeners, &subscriber{ch: l, ctx: ctx})
+	cam.mutex.Unlock()
+
+	var err error
+	if first {
+		err = cam.start(connCtx, gen)
+	}
+
+	// ctx.Done() is nil for context.Background()/context.TODO(), which never
+	// fires; only watch it when it actually can, so Subscribe() callers
+	// don't leak a goroutine per subscription.
+	if done := ctx.Done(); done != nil {
+		go func() {
+			<-done
+			cam.Unsubscribe(l)
+		}()
+	}
+
 	return l, err
 }
 
 // Unsubscribe removes a channel returned from a Subscribe call
 // from the list of cam listeners. Unsubscribe returns a boolean
 // value of whether the channel was found and removed from the listeners.
+// The search and removal happen under a single lock acquisition so a
+// concurrent Unsubscribe can't shrink cam.listeners out from under the
+// index this call is about to use.
 func (cam *Camera) Unsubscribe(unsub <-chan Frame) bool {
-	for i, l := range cam.listeners {
-		if unsub == l {
-			go func() {
-				cam.mutex.Lock()
-				if len(cam.listeners) == 1 {
-					cam.Stop()
-				} else {
-					cam.listeners = append(
-						cam.listeners[:i],
-						cam.listeners[i+1:]...,
-					)
-				}
-				close(l)
-				cam.mutex.Unlock()
-			}()
+	cam.mutex.Lock()
+	defer cam.mutex.Unlock()
+
+	for i, s := range cam.listeners {
+		if unsub == s.ch {
+			if len(cam.listeners) == 1 {
+				cam.Reconnect = false
+				cam.stopLocked()
+				cam.listeners = make([]*subscriber, 0)
+			} else {
+				cam.listeners = append(
+					cam.listeners[:i],
+					cam.listeners[i+1:]...,
+				)
+			}
+			close(s.ch)
 			return true
 		}
 	}
 	return false
 }
 
+// Stop disables reconnect, tears down the current connection, and clears
+// all listeners.
 func (cam *Camera) Stop() {
+	cam.mutex.Lock()
 	cam.Reconnect = false
-	cam.stop()
-	cam.listeners = make([]chan Frame, 0)
+	cam.stopLocked()
+	cam.listeners = make([]*subscriber, 0)
+	cam.mutex.Unlock()
+}
+
+// Handler returns an http.Handler that re-serves this Camera's MJPEG
+// stream to any number of downstream HTTP clients, the same "one upstream,
+// many muxed streams" pattern applied at the MJPEG layer: each request
+// gets its own SubscribeContext subscription, written out as a
+// multipart/x-mixed-replace response and flushed after every part.
+// MinFrameInterval, if set, limits how often frames are forwarded to each
+// client, and emit's per-subscriber drop policy keeps one hung viewer
+// from back-pressuring the rest of the fan-out.
+func (cam *Camera) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming not supported", http.StatusInternalServerError)
+			return
+		}
+
+		ctx := r.Context()
+		frames, err := cam.SubscribeContext(ctx)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		boundary := "camhandler"
+		w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary="+boundary)
+		w.WriteHeader(http.StatusOK)
+
+		mw := multipart.NewWriter(w)
+		mw.SetBoundary(boundary)
+		defer mw.Close()
+
+		var last time.Time
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case frame, ok := <-frames:
+				if !ok {
+					return
+				}
+				if cam.MinFrameInterval > 0 && time.Since(last) < cam.MinFrameInterval {
+					continue
+				}
+				last = time.Now()
+
+				header := make(textproto.MIMEHeader)
+				header.Set("Content-Type", "image/jpeg")
+				header.Set("Content-Length", strconv.Itoa(len(frame.Bytes)))
+				part, err := mw.CreatePart(header)
+				if err != nil {
+					return
+				}
+				if _, err := part.Write(frame.Bytes); err != nil {
+					return
+				}
+				flusher.Flush()
+			}
+		}
+	})
 }
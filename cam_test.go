@@ -1,12 +1,17 @@
 package cam
 
 import (
+	"context"
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"net/textproto"
+	"runtime"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func setup() *httptest.Server {
@@ -19,18 +24,18 @@ func setup() *httptest.Server {
 		writer := multipart.NewWriter(w)
 		writer.SetBoundary(boundary)
 
-		closed := false
+		var closed atomic.Bool
 
 		cn := w.(http.CloseNotifier).CloseNotify()
 
 		go func() {
 			<-cn
-			closed = true
+			closed.Store(true)
 		}()
 
 		frame := []byte("not really a jpeg")
 		for {
-			if closed {
+			if closed.Load() {
 				writer.Close()
 				return
 			}
@@ -120,3 +125,140 @@ func TestUnsubscribe(t *testing.T) {
 		t.Fatal("Unsubscribe did not remove all listeners")
 	}
 }
+
+func TestKeepaliveWaitsForFirstFrame(t *testing.T) {
+	camera := Camera{
+		HeartbeatInterval:   10 * time.Millisecond,
+		MaxMissedHeartbeats: 1,
+	}
+
+	stopCh := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		camera.keepalive(stopCh, 0)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("keepalive stopped before a first frame ever arrived")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(stopCh)
+	<-done
+}
+
+func TestHTTPTransportInvalidRootCA(t *testing.T) {
+	camera := Camera{RootCAsPEM: []byte("not a pem bundle")}
+
+	if _, err := camera.httpTransport(); err == nil {
+		t.Fatal("expected an error building a transport from an invalid CA bundle")
+	}
+}
+
+func TestSubscribeContextCancel(t *testing.T) {
+	ts := setup()
+	defer ts.Close()
+
+	camera := Camera{URL: ts.URL}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sub, err := camera.SubscribeContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+
+	select {
+	case _, ok := <-sub:
+		if ok {
+			// drain until close, in case a frame was in flight
+			for range sub {
+			}
+		}
+	case <-time.After(time.Second):
+		t.Fatal("ctx cancellation did not unsubscribe the channel")
+	}
+}
+
+func TestSubscribeNoGoroutineLeak(t *testing.T) {
+	ts := setup()
+	defer ts.Close()
+
+	camera := Camera{URL: ts.URL}
+
+	before := runtime.NumGoroutine()
+
+	for i := 0; i < 50; i++ {
+		sub, err := camera.Subscribe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !camera.Unsubscribe(sub) {
+			t.Fatal("unable to unsubscribe channel")
+		}
+	}
+
+	// give any leftover goroutines a chance to exit before sampling
+	time.Sleep(50 * time.Millisecond)
+	runtime.GC()
+
+	after := runtime.NumGoroutine()
+	if after > before+5 {
+		t.Fatalf("goroutine count grew from %d to %d after 50 Subscribe/Unsubscribe cycles", before, after)
+	}
+}
+
+func TestBackoffPolicyDelay(t *testing.T) {
+	p := BackoffPolicy{
+		InitialInterval: time.Second,
+		MaxInterval:     4 * time.Second,
+		Multiplier:      2,
+	}
+
+	cases := []struct {
+		attempt uint
+		want    time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 4 * time.Second},
+	}
+
+	for _, c := range cases {
+		if got := p.delay(c.attempt); got != c.want {
+			t.Fatalf("delay(%d) = %s, want %s", c.attempt, got, c.want)
+		}
+	}
+}
+
+func TestHandlerConcurrentSubscribeUnsubscribe(t *testing.T) {
+	ts := setup()
+	defer ts.Close()
+
+	camera := Camera{URL: ts.URL}
+	hts := httptest.NewServer(camera.Handler())
+	defer hts.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				resp, err := http.Get(hts.URL)
+				if err != nil {
+					continue
+				}
+				buf := make([]byte, 32)
+				resp.Body.Read(buf)
+				time.Sleep(200 * time.Microsecond)
+				resp.Body.Close()
+			}
+		}()
+	}
+	wg.Wait()
+}